@@ -54,120 +54,152 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/mvo5/libsmbclient-go"
 	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
-	"github.com/ubuntu/adsys/internal/i18n"
-	"golang.org/x/sync/errgroup"
 )
 
 /*
 fetch downloads a list of gpos from a url for a given kerberosTicket and stores the downloaded files in dest.
-Each gpo entry must be a gpo, with a name, url of the form: smb://<server>/SYSVOL/<AD domain>/<GPO_ID> and mutex.
+Each gpo entry must be a name mapped to one or more candidate SMB URLs of the
+form smb://<server>/SYSVOL/<AD domain>/<GPO_ID>, tried in order so a flaky DC
+can be failed over to the next one.
 If krb5Ticket is empty, no authentication is done on samba.
 */
-func (ad *AD) fetch(ctx context.Context, krb5Ticket string, gpos map[string]string) error {
+func (ad *AD) fetch(ctx context.Context, krb5Ticket string, gpos map[string][]string) error {
 	dest := ad.gpoCacheDir
 
-	// protect env variable and map creation
-	ad.Lock()
-	defer ad.Unlock()
-
-	// libsmbclient overrides sigchild without setting SA_ONSTACK
-	// It means that any cmd.Wait() would segfault when ran concurrently with this.
-	// Fortunately, we only execute subprocess in the AD package, and we have a single
-	// AD object with a mutex.
-	defer C.restoresigchild()
+	// Avoid racing with a concurrent prune touching the same directory.
+	unlock, err := lockGPOCacheDir(dest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	// Set kerberos ticket.
+	// Only the env variable mutation below needs ad's mutex: each download
+	// locks it again, briefly, around client creation (see newSMBClient).
+	// Keeping it unlocked here is what lets the worker pool in runDownloads
+	// actually fetch GPOs in parallel.
 	const krb5TicketEnv = "KRB5CCNAME"
+	ad.Lock()
 	oldKrb5Ticket := os.Getenv(krb5TicketEnv)
 	if err := os.Setenv(krb5TicketEnv, krb5Ticket); err != nil {
+		ad.Unlock()
 		return err
 	}
+	ad.Unlock()
 	defer func() {
+		ad.Lock()
+		defer ad.Unlock()
 		if err := os.Setenv(krb5TicketEnv, oldKrb5Ticket); err != nil {
 			log.Errorf(ctx, "Couln't restore initial value for %s: %v", krb5Ticket, err)
 		}
 	}()
 
-	errg := new(errgroup.Group)
-	for name, url := range gpos {
-		g, ok := ad.gpos[name]
-		if !ok {
-			ad.gpos[name] = gpo{
-				name: name,
-				url:  url,
-				mu:   &sync.RWMutex{},
-			}
-			g = ad.gpos[name]
-		}
-		errg.Go(func() (err error) {
-			defer func() {
-				if err != nil {
-					err = fmt.Errorf(i18n.G("couldn't download GPO %q: %v"), g.name, err)
-				}
-			}()
-
-			log.Debugf(ctx, "Analyzing GPO %q", g.name)
-
-			dest := filepath.Join(dest, filepath.Base(g.url))
-			client := libsmbclient.New()
-			defer client.Close()
-
-			// When testing we cannot use kerberos without a real kerberos server
-			// So we don't use kerberos in this case
-			if ad.withoutKerberos {
-				client.SetUseKerberos()
-			}
+	metrics := newDownloadMetrics()
+	ad.Lock()
+	ad.metrics = metrics
+	ad.Unlock()
 
-			// Look at GPO version and compare with the one on AD to decide if we redownload or not
-			shouldDownload, err := gpoNeedsDownload(ctx, client, g, dest)
-			if err != nil {
-				return err
-			}
-			if !shouldDownload {
-				return nil
-			}
+	return ad.runDownloads(ctx, dest, gpos, metrics)
+}
 
-			log.Infof(ctx, "Downloading GPO %q", g.name)
-			g.mu.Lock()
-			defer g.mu.Unlock()
-			// Download GPO in a temporary directory and only commit it if fully downloaded without any errors
-			tmpdest, err := ioutil.TempDir("", "adsys_gpo_*")
-			if err != nil {
-				return err
-			}
-			if err := downloadRecursive(client, g.url, tmpdest); err != nil {
-				return err
-			}
-			// Remove previous GPO
-			if err := os.RemoveAll(dest); err != nil {
-				return err
-			}
-			// Rename temporary directory to final location
-			if err := os.Rename(tmpdest, dest); err != nil {
-				return err
-			}
+// newSMBClient creates a libsmbclient.Client under ad's mutex, since client
+// creation touches process-wide signal handler state (see restoresigchild
+// below) and isn't safe to run concurrently with itself. The network I/O
+// that follows runs unlocked so downloads of different GPOs proceed in
+// parallel.
+func (ad *AD) newSMBClient() *libsmbclient.Client {
+	ad.Lock()
+	defer ad.Unlock()
+
+	// libsmbclient overrides sigchild without setting SA_ONSTACK
+	// It means that any cmd.Wait() would segfault when ran concurrently with this.
+	// Fortunately, we only execute subprocess in the AD package, and we have a single
+	// AD object with a mutex.
+	defer C.restoresigchild()
 
-			return nil
-		})
+	client := libsmbclient.New()
+	// When testing we cannot use kerberos without a real kerberos server
+	// So we don't use kerberos in this case
+	if ad.withoutKerberos {
+		client.SetUseKerberos()
 	}
 
-	if err := errg.Wait(); err != nil {
-		return fmt.Errorf("one or more error while fetching GPOs: %v", err)
+	return client
+}
+
+// downloadGPO fetches g from dcURL into dest if the remote version is newer
+// than what's cached locally, reusing unchanged files from the previous
+// download (see downloadRecursive).
+//
+// gpoNeedsDownload and downloadRecursive are driven through runCancelable,
+// since the underlying libsmbclient calls can't be interrupted: on
+// ctx.Done() this returns ctx.Err() without waiting for them to actually
+// stop running in the background.
+func (ad *AD) downloadGPO(ctx context.Context, dest string, g gpo, dcURL string, metrics *DownloadMetrics) (err error) {
+	log.Debugf(ctx, "Analyzing GPO %q against %s", g.name, dcHost(dcURL))
+
+	localPath := filepath.Join(dest, filepath.Base(dcURL))
+
+	client := ad.newSMBClient()
+	// Client.Close() also takes libsmbclient's global lock, so it would
+	// block here on the very call we just gave up waiting for. If we
+	// bailed out on ctx, close asynchronously instead: the client is
+	// released whenever that abandoned call eventually returns, without
+	// making us wait for it too.
+	defer func() {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			go func() { _ = client.Close() }()
+			return
+		}
+		_ = client.Close()
+	}()
+
+	var shouldDownload bool
+	if err = runCancelable(ctx, func() error {
+		var innerErr error
+		shouldDownload, innerErr = gpoNeedsDownload(ctx, client, g, dcURL, localPath)
+		return innerErr
+	}); err != nil {
+		return err
 	}
+	if !shouldDownload {
+		return nil
+	}
+
+	log.Infof(ctx, "Downloading GPO %q from %s", g.name, dcHost(dcURL))
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	return nil
+	// Download GPO in a temporary directory and only commit it if fully downloaded without any errors
+	tmpdest, err := os.MkdirTemp("", "adsys_gpo_*")
+	if err != nil {
+		return err
+	}
+	oldManifest := loadGPOManifest(localPath)
+	newManifest := make(gpoManifest)
+	if err = runCancelable(ctx, func() error {
+		return ad.downloadRecursive(client, dcURL, tmpdest, localPath, "", oldManifest, newManifest, metrics)
+	}); err != nil {
+		return err
+	}
+	if err := newManifest.save(tmpdest); err != nil {
+		return err
+	}
+	// Remove previous GPO
+	if err := os.RemoveAll(localPath); err != nil {
+		return err
+	}
+	// Rename temporary directory to final location
+	return os.Rename(tmpdest, localPath)
 }
 
-func gpoNeedsDownload(ctx context.Context, client *libsmbclient.Client, g gpo, localPath string) (bool, error) {
+func gpoNeedsDownload(ctx context.Context, client *libsmbclient.Client, g gpo, dcURL, localPath string) (bool, error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
@@ -180,7 +212,7 @@ func gpoNeedsDownload(ctx context.Context, client *libsmbclient.Client, g gpo, l
 		}
 	}
 
-	f, err := client.Open(fmt.Sprintf("%s/GPT.INI", g.url), 0, 0)
+	f, err := client.Open(fmt.Sprintf("%s/GPT.INI", dcURL), 0, 0)
 	if err != nil {
 		return false, err
 	}
@@ -213,55 +245,3 @@ func getGPOVersion(r io.Reader) (version int, err error) {
 
 	return 0, errors.New("version not found")
 }
-
-func downloadRecursive(client *libsmbclient.Client, url string, dest string) error {
-	d, err := client.Opendir(url)
-	if err != nil {
-		return err
-	}
-	defer d.Closedir()
-
-	if err := os.MkdirAll(dest, 0700); err != nil {
-		return fmt.Errorf("can't create %q", dest)
-	}
-
-	for {
-		dirent, err := d.Readdir()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		if dirent.Name == "." || dirent.Name == ".." {
-			continue
-		}
-
-		entityURL := url + "/" + dirent.Name
-		entityDest := filepath.Join(dest, dirent.Name)
-
-		if dirent.Type == libsmbclient.SmbcFile {
-			f, err := client.Open(entityURL, 0, 0)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			// Read() is on *libsmbclient.File, not libsmbclient.File
-			pf := &f
-			data, err := ioutil.ReadAll(pf)
-
-			if err := ioutil.WriteFile(entityDest, data, 0700); err != nil {
-				return err
-			}
-		} else if dirent.Type == libsmbclient.SmbcDir {
-			err := downloadRecursive(client, entityURL, entityDest)
-			if err != nil {
-				return err
-			}
-		} else {
-			return fmt.Errorf("unsupported type %q for entry %s", dirent.Type, dirent.Name)
-		}
-	}
-	return nil
-}
@@ -0,0 +1,334 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/i18n"
+)
+
+const (
+	// downloadMaxRetries is the number of retries attempted against a single
+	// DC before failing over to the next candidate URL for that GPO.
+	downloadMaxRetries = 4
+	// downloadBaseBackoff and downloadMaxBackoff bound the exponential
+	// backoff applied between retries.
+	downloadBaseBackoff = 200 * time.Millisecond
+	downloadMaxBackoff  = 10 * time.Second
+	// downloadJobTimeout bounds how long a single download attempt (one GPO,
+	// one DC, one try) is allowed to hang for before being cancelled.
+	//
+	// Caveat: github.com/mvo5/libsmbclient-go's Open/Opendir/Readdir/Read
+	// are blocking cgo calls with no cancellation support, and every
+	// *libsmbclient.Client shares one package-level mutex held for the
+	// duration of each such call (see runCancelable). So this timeout
+	// bounds how long *we* wait on a stuck call, not how long the call
+	// itself keeps running: a DC that truly hangs mid-syscall still holds
+	// that global lock until it eventually returns (or the process is
+	// killed), which will stall every other worker's SMB calls too,
+	// regardless of which DC they're talking to.
+	downloadJobTimeout = 2 * time.Minute
+)
+
+// defaultMaxConcurrentDownloads is used when AD.maxConcurrentDownloads is
+// left at its zero value.
+func defaultMaxConcurrentDownloads() int {
+	n := runtime.NumCPU()
+	if n > 8 {
+		n = 8
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// maxConcurrentDownloads returns how many GPOs ad.runDownloads should fetch
+// in parallel.
+func maxConcurrentDownloads(ad *AD) int {
+	if ad.maxConcurrentDownloads > 0 {
+		return ad.maxConcurrentDownloads
+	}
+	return defaultMaxConcurrentDownloads()
+}
+
+// downloadJob is one GPO to fetch, with every known SMB URL to try for it,
+// in priority order (first is the preferred DC).
+type downloadJob struct {
+	name string
+	urls []string
+}
+
+// DownloadMetrics accumulates counters about a fetch run, surfaced by the
+// gRPC service: total bytes transferred, retries performed, and the latency
+// of the last exchange with each DC.
+type DownloadMetrics struct {
+	bytesTransferred uint64
+	retries          uint64
+
+	mu          sync.Mutex
+	dcLatencies map[string]time.Duration
+}
+
+// newDownloadMetrics returns an empty DownloadMetrics ready to use.
+func newDownloadMetrics() *DownloadMetrics {
+	return &DownloadMetrics{dcLatencies: make(map[string]time.Duration)}
+}
+
+func (m *DownloadMetrics) addBytes(n uint64) {
+	atomic.AddUint64(&m.bytesTransferred, n)
+}
+
+func (m *DownloadMetrics) addRetry() {
+	atomic.AddUint64(&m.retries, 1)
+}
+
+func (m *DownloadMetrics) recordDCLatency(dc string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dcLatencies[dc] = d
+}
+
+// DownloadMetricsSnapshot is a point-in-time, read-only copy of a
+// DownloadMetrics, safe to serialize on the gRPC service.
+type DownloadMetricsSnapshot struct {
+	BytesTransferred uint64
+	Retries          uint64
+	DCLatencies      map[string]time.Duration
+}
+
+// Snapshot returns a copy of m.
+func (m *DownloadMetrics) Snapshot() DownloadMetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	latencies := make(map[string]time.Duration, len(m.dcLatencies))
+	for dc, d := range m.dcLatencies {
+		latencies[dc] = d
+	}
+
+	return DownloadMetricsSnapshot{
+		BytesTransferred: atomic.LoadUint64(&m.bytesTransferred),
+		Retries:          atomic.LoadUint64(&m.retries),
+		DCLatencies:      latencies,
+	}
+}
+
+// Metrics returns a snapshot of the most recent fetch's download metrics,
+// meant to be exposed by the gRPC service.
+func (ad *AD) Metrics() DownloadMetricsSnapshot {
+	ad.Lock()
+	metrics := ad.metrics
+	ad.Unlock()
+
+	if metrics == nil {
+		return DownloadMetricsSnapshot{}
+	}
+	return metrics.Snapshot()
+}
+
+// isTransientSMBError classifies errors worth retrying against the same (or
+// a failover) DC: anything that looks like a flaky network condition rather
+// than a permanent failure such as bad auth or a missing GPO.
+func isTransientSMBError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, transient := range []string{
+		"connection reset",
+		"connection refused",
+		"broken pipe",
+		"timed out",
+		"timeout",
+		"temporary failure",
+		"i/o timeout",
+		"no route to host",
+		"network is unreachable",
+	} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoffWithJitter returns the delay to wait before retry number attempt
+// (0-indexed), growing exponentially and capped at downloadMaxBackoff, with
+// up to 50% jitter to avoid every worker retrying in lockstep.
+func backoffWithJitter(attempt int) time.Duration {
+	d := time.Duration(float64(downloadBaseBackoff) * math.Pow(2, float64(attempt)))
+	if d > downloadMaxBackoff {
+		d = downloadMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// dcHost returns the server component of a smb://server/... URL, used as a
+// short label for logs and per-DC metrics.
+func dcHost(url string) string {
+	host := strings.TrimPrefix(url, "smb://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// runDownloads fetches every GPO in gpos into dest, using a worker pool
+// bounded by maxConcurrentDownloads(ad) so downloads actually run in
+// parallel instead of one goroutine per GPO unbounded.
+func (ad *AD) runDownloads(ctx context.Context, dest string, gpos map[string][]string, metrics *DownloadMetrics) error {
+	jobs := make(chan downloadJob)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	workers := maxConcurrentDownloads(ad)
+	if workers > len(gpos) {
+		workers = len(gpos)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := ad.downloadGPOWithFailover(ctx, dest, job, metrics); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for name, urls := range gpos {
+		jobs <- downloadJob{name: name, urls: urls}
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf(i18n.G("one or more error while fetching GPOs: %v"), errs)
+	}
+
+	return nil
+}
+
+// downloadGPOWithFailover downloads job, trying each of its candidate DC
+// URLs in order (retrying transient errors on each one) until one succeeds
+// or all of them have been exhausted.
+func (ad *AD) downloadGPOWithFailover(ctx context.Context, dest string, job downloadJob, metrics *DownloadMetrics) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf(i18n.G("couldn't download GPO %q: %w"), job.name, err)
+		}
+	}()
+
+	if len(job.urls) == 0 {
+		return errors.New(i18n.G("no candidate DC URL"))
+	}
+
+	ad.Lock()
+	g, ok := ad.gpos[job.name]
+	if !ok {
+		g = gpo{name: job.name, url: job.urls[0], mu: &sync.RWMutex{}}
+		ad.gpos[job.name] = g
+	}
+	ad.Unlock()
+
+	var lastErr error
+	for _, dcURL := range job.urls {
+		start := time.Now()
+		lastErr = ad.downloadGPOWithRetry(ctx, dest, g, dcURL, metrics)
+		metrics.recordDCLatency(dcHost(dcURL), time.Since(start))
+		if lastErr == nil {
+			return nil
+		}
+		log.Warningf(ctx, "GPO %q failed against %s, trying next DC if any: %v", job.name, dcHost(dcURL), lastErr)
+	}
+
+	return lastErr
+}
+
+// runCancelable runs f in its own goroutine and returns as soon as either f
+// completes or ctx is done, whichever comes first.
+//
+// This exists because libsmbclient-go gives us no way to actually interrupt
+// a blocked Open/Opendir/Readdir/Read: they're synchronous cgo calls, so a
+// DC that hangs mid-call leaves f's goroutine blocked indefinitely. On
+// ctx.Done() we stop waiting and return ctx.Err(), abandoning that
+// goroutine rather than the call it's stuck in — a deliberate, documented
+// leak, since giving up on the wait is strictly better than hanging the
+// caller (and every other worker queued behind the same DC) forever. The
+// abandoned goroutine still holds libsmbclient's global smbMu for as long
+// as it runs, so other workers can stall on an unrelated, healthy DC until
+// it finally returns.
+func runCancelable(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadGPOWithRetry attempts to download g from dcURL, retrying
+// transient libsmbclient errors with exponential backoff and jitter up to
+// downloadMaxRetries times. Each attempt runs under its own timeout so a
+// hung DC can't stall the worker forever.
+func (ad *AD) downloadGPOWithRetry(ctx context.Context, dest string, g gpo, dcURL string, metrics *DownloadMetrics) error {
+	var lastErr error
+	for attempt := 0; attempt <= downloadMaxRetries; attempt++ {
+		if attempt > 0 {
+			metrics.addRetry()
+			select {
+			case <-time.After(backoffWithJitter(attempt - 1)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		jobCtx, cancel := context.WithTimeout(ctx, downloadJobTimeout)
+		err := ad.downloadGPO(jobCtx, dest, g, dcURL, metrics)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+		if !isTransientSMBError(err) {
+			return err
+		}
+		log.Warningf(ctx, "Transient error downloading GPO %q from %s (attempt %d/%d): %v", g.name, dcHost(dcURL), attempt+1, downloadMaxRetries+1, err)
+	}
+
+	return lastErr
+}
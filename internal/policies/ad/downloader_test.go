@@ -0,0 +1,153 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadMetricsAccumulatesAcrossGoroutines(t *testing.T) {
+	t.Parallel()
+
+	m := newDownloadMetrics()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.addBytes(100)
+			m.addRetry()
+			m.recordDCLatency("dc1.example.com", time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	snap := m.Snapshot()
+	require.EqualValues(t, 1000, snap.BytesTransferred, "addBytes should accumulate across every caller")
+	require.EqualValues(t, 10, snap.Retries, "addRetry should accumulate across every caller")
+	require.Equal(t, time.Millisecond, snap.DCLatencies["dc1.example.com"], "recordDCLatency should record the last latency seen for that DC")
+}
+
+func TestDownloadMetricsSnapshotIsIndependentCopy(t *testing.T) {
+	t.Parallel()
+
+	m := newDownloadMetrics()
+	m.recordDCLatency("dc1.example.com", time.Second)
+
+	snap := m.Snapshot()
+	m.recordDCLatency("dc1.example.com", 2*time.Second)
+	m.recordDCLatency("dc2.example.com", time.Second)
+
+	require.Equal(t, time.Second, snap.DCLatencies["dc1.example.com"], "a snapshot must not change when the live metrics are updated afterwards")
+	_, ok := snap.DCLatencies["dc2.example.com"]
+	require.False(t, ok, "a snapshot must not see DCs recorded after it was taken")
+}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool   { return true }
+func (fakeTimeoutError) Temporary() bool { return true }
+
+func TestIsTransientSMBError(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		err error
+
+		want bool
+	}{
+		"nil error is not transient":                 {err: nil, want: false},
+		"net timeout error is transient":             {err: fakeTimeoutError{}, want: true},
+		"connection reset message is transient":      {err: errors.New("read: connection reset by peer"), want: true},
+		"connection refused message is transient":    {err: errors.New("dial tcp: connection refused"), want: true},
+		"no route to host message is transient":      {err: errors.New("no route to host"), want: true},
+		"permission denied message is not transient": {err: errors.New("NT_STATUS_ACCESS_DENIED"), want: false},
+		"gpo not found message is not transient":     {err: errors.New("no such file or directory"), want: false},
+	}
+
+	var _ net.Error = fakeTimeoutError{}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, isTransientSMBError(tc.err))
+		})
+	}
+}
+
+func TestBackoffWithJitterGrowsAndCaps(t *testing.T) {
+	t.Parallel()
+
+	first := backoffWithJitter(0)
+	require.Greater(t, first, time.Duration(0), "backoff should never be zero")
+	require.LessOrEqual(t, first, downloadBaseBackoff, "first attempt's backoff shouldn't exceed the base backoff")
+
+	// With up to 50% jitter, attempt 3's backoff is at least 4x the base backoff.
+	require.Greater(t, backoffWithJitter(3), downloadBaseBackoff, "backoff should grow with the attempt number")
+
+	// A late attempt should be capped at downloadMaxBackoff, jitter included.
+	late := backoffWithJitter(20)
+	require.LessOrEqual(t, late, downloadMaxBackoff, "backoff should be capped at downloadMaxBackoff")
+}
+
+func TestDCHost(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		url string
+
+		want string
+	}{
+		"url with path returns host only": {url: "smb://dc1.example.com/SYSVOL/domain/gpo", want: "dc1.example.com"},
+		"url with no path returns host":   {url: "smb://dc1.example.com", want: "dc1.example.com"},
+	}
+
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, dcHost(tc.url))
+		})
+	}
+}
+
+func TestRunCancelableReturnsFuncResult(t *testing.T) {
+	t.Parallel()
+
+	wantErr := errors.New("boom")
+	err := runCancelable(context.Background(), func() error { return wantErr })
+	require.ErrorIs(t, err, wantErr, "runCancelable should return f's own error")
+}
+
+func TestRunCancelableReturnsCtxErrOnTimeout(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	err := runCancelable(ctx, func() error {
+		<-block
+		return nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded, "runCancelable should give up and return ctx's error once it's done, even though f is still blocked")
+}
+
+// Note: downloadGPOWithRetry/downloadGPOWithFailover themselves (the actual
+// retry-then-failover sequencing) aren't covered here. This snapshot of the
+// tree doesn't include the ad.go defining the AD type they're methods of, so
+// there's nothing to construct one from; the pieces of logic they're built
+// from — transient-error classification, backoff, and DownloadMetrics — are
+// covered above instead.
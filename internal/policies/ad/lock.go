@@ -0,0 +1,37 @@
+package ad
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// gpoCacheLockFileName is the advisory lock guarding gpoCacheDir so that a
+// fetch and a prune running concurrently don't step on each other's files.
+const gpoCacheLockFileName = ".lock"
+
+// lockGPOCacheDir takes an exclusive advisory lock on dest, creating it if
+// needed. The returned func releases the lock.
+func lockGPOCacheDir(dest string) (unlock func() error, err error) {
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dest, gpoCacheLockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
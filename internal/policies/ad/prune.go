@@ -0,0 +1,110 @@
+package ad
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ubuntu/adsys/internal/decorate"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/i18n"
+)
+
+// DefaultPruneMinAge is the retention window applied when PruneOptions.MinAge
+// is left at its zero value.
+const DefaultPruneMinAge = 7 * 24 * time.Hour
+
+// PruneOptions controls the retention policy applied by AD.Prune.
+type PruneOptions struct {
+	// MinAge is how long an unreferenced GPO download must sit on disk
+	// before being removed. Zero means DefaultPruneMinAge.
+	MinAge time.Duration
+	// DryRun logs what would be removed without deleting anything.
+	DryRun bool
+}
+
+// Prune removes GPO downloads under ad.gpoCacheDir that are not in keep
+// (the set of GPO IDs currently referenced by at least one user or host)
+// and whose on-disk mtime is older than opts.MinAge. It's meant to be called
+// at the end of each refresh cycle.
+func (ad *AD) Prune(ctx context.Context, keep map[string]struct{}, opts PruneOptions) (err error) {
+	defer decorate.OnError(&err, i18n.G("can't prune GPO cache %s"), ad.gpoCacheDir)
+
+	if opts.MinAge <= 0 {
+		opts.MinAge = DefaultPruneMinAge
+	}
+
+	// Avoid racing with a concurrent fetch touching the same directory.
+	unlock, err := lockGPOCacheDir(ad.gpoCacheDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := os.ReadDir(ad.gpoCacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	cutoff := time.Now().Add(-opts.MinAge)
+
+	ad.Lock()
+	defer ad.Unlock()
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if _, ok := keep[name]; ok {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(ad.gpoCacheDir, name)
+		size, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+
+		if opts.DryRun {
+			log.Infof(ctx, "Would prune GPO %q (%d bytes on disk since %s)", name, size, fi.ModTime())
+			continue
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf(i18n.G("can't remove %s: %w"), path, err)
+		}
+		delete(ad.gpos, name)
+
+		log.Infof(ctx, "Pruned GPO %q, reclaimed %d bytes", name, size)
+	}
+
+	return nil
+}
+
+// dirSize returns the total size in bytes of all regular files under path.
+func dirSize(path string) (size int64, err error) {
+	err = filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,60 @@
+package ad
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirSize(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a"), []byte("1234"), 0600), "Setup: should be able to write a")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700), "Setup: should be able to create sub")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b"), []byte("123"), 0600), "Setup: should be able to write sub/b")
+
+	size, err := dirSize(dir)
+	require.NoError(t, err, "dirSize should succeed")
+	require.Equal(t, int64(7), size, "dirSize should sum every regular file's size, recursively")
+}
+
+func TestDirSizeOnMissingPath(t *testing.T) {
+	t.Parallel()
+
+	_, err := dirSize(filepath.Join(t.TempDir(), "does-not-exist"))
+	require.Error(t, err, "dirSize should error on a path that doesn't exist")
+}
+
+func TestLockGPOCacheDirExcludesConcurrentLocker(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	unlock, err := lockGPOCacheDir(dir)
+	require.NoError(t, err, "first lock should succeed")
+
+	// A second, independent attempt to lock the same file non-blockingly
+	// must fail while the first lock is still held.
+	f, err := os.OpenFile(filepath.Join(dir, gpoCacheLockFileName), os.O_RDWR, 0600)
+	require.NoError(t, err, "Setup: should be able to open the lock file")
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	require.Error(t, err, "a second exclusive lock attempt should fail while the first is held")
+
+	require.NoError(t, unlock(), "unlock should succeed")
+
+	// Once released, the same non-blocking attempt should now succeed.
+	require.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB), "lock should be acquirable once released")
+	require.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_UN))
+}
+
+// Note: AD.Prune itself (keep-set / MinAge / DryRun behavior) isn't covered
+// here. This snapshot of the tree doesn't include the ad.go defining the AD
+// type Prune is a method of, so there's no way to construct one to drive it
+// against; dirSize and lockGPOCacheDir, the two pieces of standalone logic
+// Prune is built from, are covered above instead.
@@ -0,0 +1,73 @@
+package ad
+
+/*
+#cgo pkg-config: smbclient
+#include <stdlib.h>
+#include <libsmbclient.h>
+
+extern void restoresigchild();
+
+static int adsys_smbc_stat(SMBCCTX *c, const char *fname, struct stat *st) {
+	smbc_stat_fn fn = smbc_getFunctionStat(c);
+	return fn(c, fname, st);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// smbStat returns the size and modification time libsmbclient reports for
+// the remote file at url, without transferring any of its content. It's
+// what lets downloadFile skip re-downloading a file that hasn't changed.
+//
+// libsmbclient-go doesn't expose smbc_stat, and libsmbclient.Client keeps
+// its SMBCCTX private, so rather than fork the vendored package this opens
+// its own minimal context just for stat calls, configured the same way
+// newSMBClient configures a Client.
+func (ad *AD) smbStat(url string) (size int64, mtime time.Time, err error) {
+	ctx, err := ad.newStatContext()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer C.smbc_free_context(ctx, 1)
+
+	cURL := C.CString(url)
+	defer C.free(unsafe.Pointer(cURL))
+
+	var st C.struct_stat
+	if rc := C.adsys_smbc_stat(ctx, cURL, &st); rc != 0 {
+		return 0, time.Time{}, fmt.Errorf("can't stat %q", url)
+	}
+
+	return int64(st.st_size), time.Unix(int64(st.st_mtim.tv_sec), int64(st.st_mtim.tv_nsec)), nil
+}
+
+// newStatContext creates a fresh SMBCCTX for a single smbStat call. Like
+// newSMBClient, context creation touches process-wide signal handler state
+// (see restoresigchild in download.go) and isn't safe to run concurrently
+// with itself, so it happens under ad's mutex; the stat call itself runs
+// unlocked.
+func (ad *AD) newStatContext() (*C.SMBCCTX, error) {
+	ad.Lock()
+	defer ad.Unlock()
+	defer C.restoresigchild()
+
+	ctx := C.smbc_new_context()
+	if ctx == nil {
+		return nil, errors.New("can't create samba stat context")
+	}
+	if C.smbc_init_context(ctx) == nil {
+		C.smbc_free_context(ctx, 1)
+		return nil, errors.New("can't initialize samba stat context")
+	}
+	if ad.withoutKerberos {
+		C.smbc_setOptionUseKerberos(ctx, 1)
+	}
+
+	return ctx, nil
+}
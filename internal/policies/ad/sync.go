@@ -0,0 +1,231 @@
+package ad
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mvo5/libsmbclient-go"
+	"gopkg.in/yaml.v3"
+)
+
+// gpoManifestFileName is written to a GPO's cache dir on every successful
+// download, recording enough per-file metadata to skip re-downloading
+// unchanged files on the next sync.
+const gpoManifestFileName = "GPO-MANIFEST.yaml"
+
+// manifestFileEntry describes one file tracked by a gpoManifest.
+type manifestFileEntry struct {
+	Size    int64     `yaml:"size"`
+	ModTime time.Time `yaml:"mtime"`
+	Sha256  string    `yaml:"sha256"`
+}
+
+// gpoManifest maps a GPO-relative path to the metadata of the file it was
+// downloaded as.
+type gpoManifest map[string]manifestFileEntry
+
+// loadGPOManifest reads dir's manifest. A missing or corrupt manifest isn't
+// an error: it just means the next sync falls back to downloading
+// everything, same as if the GPO had never been seen before.
+func loadGPOManifest(dir string) gpoManifest {
+	d, err := os.ReadFile(filepath.Join(dir, gpoManifestFileName))
+	if err != nil {
+		return gpoManifest{}
+	}
+
+	m := make(gpoManifest)
+	if err := yaml.Unmarshal(d, &m); err != nil {
+		return gpoManifest{}
+	}
+
+	return m
+}
+
+// save atomically (re)writes m to dir.
+func (m gpoManifest) save(dir string) (err error) {
+	d, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, gpoManifestFileName+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(d); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, gpoManifestFileName))
+}
+
+// downloadRecursive downloads url into dest, reusing oldDest (the GPO's
+// previous download, tracked by oldManifest) for any file whose remote
+// (size, mtime) — or, failing that, content hash — turns out to be
+// unchanged instead of transferring it again, and records every file it
+// sees into newManifest. rel is the path of url relative to the GPO root,
+// used as the manifest key.
+func (ad *AD) downloadRecursive(client *libsmbclient.Client, url, dest, oldDest, rel string, oldManifest, newManifest gpoManifest, metrics *DownloadMetrics) error {
+	d, err := client.Opendir(url)
+	if err != nil {
+		return err
+	}
+	defer d.Closedir()
+
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return fmt.Errorf("can't create %q", dest)
+	}
+
+	for {
+		dirent, err := d.Readdir()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if dirent.Name == "." || dirent.Name == ".." {
+			continue
+		}
+
+		entityURL := url + "/" + dirent.Name
+		entityDest := filepath.Join(dest, dirent.Name)
+		entityOldDest := filepath.Join(oldDest, dirent.Name)
+		entityRel := dirent.Name
+		if rel != "" {
+			entityRel = rel + "/" + dirent.Name
+		}
+
+		switch dirent.Type {
+		case libsmbclient.SmbcDir:
+			if err := ad.downloadRecursive(client, entityURL, entityDest, entityOldDest, entityRel, oldManifest, newManifest, metrics); err != nil {
+				return err
+			}
+		case libsmbclient.SmbcFile:
+			if err := ad.downloadFile(client, entityURL, entityDest, entityOldDest, entityRel, oldManifest, newManifest, metrics); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported type %q for entry %s", dirent.Type, dirent.Name)
+		}
+	}
+
+	return nil
+}
+
+// downloadFile fetches url to dest, unless ad.smbStat reports the same
+// (size, mtime) already recorded for rel in oldManifest, in which case it's
+// hardlinked from oldDest without transferring any of its content at all —
+// this is what actually saves bandwidth across a version bump, rather than
+// just local disk churn.
+//
+// If the stat can't be done (older Samba servers, or a transient error) the
+// file is downloaded and hashed as before, falling back to reusing oldDest
+// whenever that hash still matches oldManifest[rel]: strictly more
+// conservative, since it still has to stream the content to know, but it
+// keeps working on servers smbStat doesn't work against.
+func (ad *AD) downloadFile(client *libsmbclient.Client, url, dest, oldDest, rel string, oldManifest, newManifest gpoManifest, metrics *DownloadMetrics) error {
+	remoteSize, remoteMTime, statErr := ad.smbStat(url)
+	if statErr == nil {
+		if old, ok := oldManifest[rel]; ok && old.Size == remoteSize && old.ModTime.Equal(remoteMTime) {
+			if err := os.Link(oldDest, dest); err != nil {
+				if err := copyFile(oldDest, dest); err != nil {
+					return err
+				}
+			}
+			newManifest[rel] = old
+			return nil
+		}
+	}
+
+	f, err := client.Open(url, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Read() is on *libsmbclient.File, not libsmbclient.File
+	pf := &f
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), pf)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	metrics.addBytes(uint64(size))
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if old, ok := oldManifest[rel]; ok && old.Sha256 == sum && old.Size == size {
+		_ = os.Remove(tmp.Name())
+		if err := os.Link(oldDest, dest); err != nil {
+			if err := copyFile(oldDest, dest); err != nil {
+				return err
+			}
+		}
+		if statErr == nil {
+			old.ModTime = remoteMTime
+		}
+		newManifest[rel] = old
+		return nil
+	}
+
+	if err := os.Chmod(tmp.Name(), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+
+	mtime := remoteMTime
+	if statErr != nil {
+		// No remote mtime available: fall back to local wall-clock time.
+		// This file just won't be eligible for the stat-based skip above
+		// until a future sync observes a successful stat for it.
+		mtime = time.Now()
+	}
+	newManifest[rel] = manifestFileEntry{Size: size, ModTime: mtime, Sha256: sum}
+	return nil
+}
+
+// copyFile is the downloadFile fallback for when oldDest can't be
+// hardlinked (e.g. it vanished, or dest is on another filesystem).
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
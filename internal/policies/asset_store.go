@@ -0,0 +1,391 @@
+package policies
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ubuntu/adsys/internal/decorate"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/i18n"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// assetsStoreDirName is the shared content-addressable blob store, a
+	// sibling of PoliciesCacheBaseName under the cache root.
+	assetsStoreDirName = "assets-store"
+	// policiesAssetsManifestFileName is the manifest mapping asset paths to
+	// blobs in the store, saved next to policiesFileName.
+	policiesAssetsManifestFileName = "assets.manifest"
+)
+
+// manifestEntry describes one asset path tracked by an assetManifest.
+type manifestEntry struct {
+	Hash  string      `yaml:"hash,omitempty"`
+	Mode  os.FileMode `yaml:"mode"`
+	Size  int64       `yaml:"size"`
+	IsDir bool        `yaml:"isDir,omitempty"`
+}
+
+// assetManifest maps an asset's relative path (as it used to appear in the
+// assets.db zip) to the blob backing it in the assetStore.
+type assetManifest map[string]manifestEntry
+
+// openManifest reads the manifest file at p, alongside the blob store that
+// backs it.
+func openManifest(p string, store *assetStore) (manifest assetManifest, err error) {
+	defer decorate.OnError(&err, "can't open assets manifest %s", p)
+
+	d, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest = make(assetManifest)
+	if err := yaml.Unmarshal(d, &manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// save writes the manifest to p.
+func (m assetManifest) save(p string) (err error) {
+	defer decorate.OnError(&err, "can't save assets manifest to %s", p)
+
+	d, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, d, 0600)
+}
+
+// storeRootForCacheDir returns the shared blob store sitting next to
+// PoliciesCacheBaseName, given the per-object policies cache directory p
+// (typically <cacheRoot>/policies/<object>).
+func storeRootForCacheDir(p string) string {
+	return filepath.Join(filepath.Dir(filepath.Dir(p)), assetsStoreDirName)
+}
+
+// assetStore is a shared, content-addressable blob store keyed by the
+// SHA-256 of each blob's content, sharded two levels deep (ab/cdef…) to
+// avoid huge directories. Blobs are refcounted so they can be shared by
+// every Policies that references them and reclaimed once nothing does.
+type assetStore struct {
+	root string
+}
+
+func newAssetStore(root string) *assetStore {
+	return &assetStore{root: root}
+}
+
+func (s *assetStore) blobPath(hash string) string {
+	return filepath.Join(s.root, hash[:2], hash[2:])
+}
+
+func (s *assetStore) refcountPath(hash string) string {
+	return s.blobPath(hash) + ".refcount"
+}
+
+// modePath is the file recording the mode that "owns" hash's shared inode,
+// i.e. the only mode link() can safely hardlink for: see claimMode.
+func (s *assetStore) modePath(hash string) string {
+	return s.blobPath(hash) + ".mode"
+}
+
+// put streams r into the store, returning the SHA-256 hash and size of its
+// content. If a blob with that hash already exists, its content is deduped:
+// the read data is discarded. put never changes hash's refcount: callers
+// that are recording a new reference to hash must incRef it themselves, so
+// that re-storing a path whose content hasn't changed doesn't leak a ref.
+func (s *assetStore) put(r io.Reader) (hash string, size int64, err error) {
+	defer decorate.OnError(&err, "can't store asset blob")
+
+	h := sha256.New()
+	tmp, err := os.CreateTemp(s.root, "blob-*.tmp")
+	if err != nil {
+		if err := os.MkdirAll(s.root, 0700); err != nil {
+			return "", 0, err
+		}
+		if tmp, err = os.CreateTemp(s.root, "blob-*.tmp"); err != nil {
+			return "", 0, err
+		}
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	hash = hex.EncodeToString(h.Sum(nil))
+	dst := s.blobPath(hash)
+
+	if _, err := os.Stat(dst); err == nil {
+		// Already have this blob: dedup, discard the freshly written copy.
+		return hash, n, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", 0, err
+	}
+
+	return hash, n, nil
+}
+
+// claimMode returns the mode that owns hash's shared inode, atomically
+// claiming mode for it if no blob has claimed one yet.
+//
+// Every link() to the same hash shares one inode, so a destination's mode
+// can only be set via chmod when nothing else is already relying on that
+// inode having a different mode: chmod'ing one hardlinked destination
+// silently flips every other destination already linked to the same hash
+// too. claimMode lets the first link() to ever touch a hash fix its mode;
+// every later link() at a different mode must copy instead (see link).
+func (s *assetStore) claimMode(hash string, mode os.FileMode) (owned os.FileMode, err error) {
+	err = s.withHashLock(hash, func() error {
+		path := s.modePath(hash)
+
+		d, readErr := os.ReadFile(path)
+		if readErr == nil {
+			v, convErr := strconv.ParseUint(strings.TrimSpace(string(d)), 8, 32)
+			if convErr == nil {
+				owned = os.FileMode(v)
+				return nil
+			}
+		} else if !os.IsNotExist(readErr) {
+			return readErr
+		}
+
+		owned = mode
+		return os.WriteFile(path, []byte(strconv.FormatUint(uint64(mode), 8)), 0600)
+	})
+	return owned, err
+}
+
+// link materializes hash at dest with the given mode, hardlinking from the
+// shared blob when that's safe (mode matches the one claimMode recorded for
+// hash, and dest is on the same filesystem) and falling back to a copy
+// otherwise.
+func (s *assetStore) link(hash, dest string, mode os.FileMode) error {
+	owned, err := s.claimMode(hash, mode)
+	if err != nil {
+		return err
+	}
+
+	if owned == mode {
+		if err := os.Link(s.blobPath(hash), dest); err == nil {
+			return os.Chmod(dest, mode)
+		} else if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+		// Cross-device: fall through to the copy below.
+	}
+
+	return s.copyBlob(hash, dest, mode)
+}
+
+// copyBlob copies hash's content from the store to dest with mode. Used by
+// link whenever hardlinking isn't possible, or would share an inode already
+// claimed at a different mode.
+func (s *assetStore) copyBlob(hash, dest string, mode os.FileMode) error {
+	in, err := os.Open(s.blobPath(hash))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// withHashLock runs f while holding an advisory lock that serializes
+// mutation of hash's on-disk store metadata (refcount, owning mode),
+// creating the lock file (hash's refcount file) if needed.
+func (s *assetStore) withHashLock(hash string, f func() error) (err error) {
+	path := s.refcountPath(hash)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	return f()
+}
+
+// withRefcountLock runs f with hash's current refcount (0 if never set)
+// while holding its lock, writing back whatever count f returns.
+func (s *assetStore) withRefcountLock(hash string, f func(count int) (int, error)) error {
+	return s.withHashLock(hash, func() error {
+		path := s.refcountPath(hash)
+
+		d, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		count := 0
+		if len(d) > 0 {
+			if count, err = strconv.Atoi(strings.TrimSpace(string(d))); err != nil {
+				count = 0
+			}
+		}
+
+		newCount, err := f(count)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(path, []byte(strconv.Itoa(newCount)), 0600)
+	})
+}
+
+func (s *assetStore) incRef(hash string) error {
+	return s.withRefcountLock(hash, func(count int) (int, error) {
+		return count + 1, nil
+	})
+}
+
+// decRef decrements hash's refcount and, once it reaches zero, removes the
+// blob and its store metadata (refcount and owning mode), returning the
+// number of bytes reclaimed.
+func (s *assetStore) decRef(hash string) (reclaimed int64, err error) {
+	var removed bool
+	err = s.withRefcountLock(hash, func(count int) (int, error) {
+		if count > 0 {
+			count--
+		}
+		if count == 0 {
+			fi, statErr := os.Stat(s.blobPath(hash))
+			if statErr == nil {
+				reclaimed = fi.Size()
+			}
+			if rmErr := os.Remove(s.blobPath(hash)); rmErr != nil && !os.IsNotExist(rmErr) {
+				return count, rmErr
+			}
+			removed = true
+		}
+		return count, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if removed {
+		_ = os.Remove(s.modePath(hash))
+		_ = os.Remove(s.refcountPath(hash))
+	}
+	return reclaimed, nil
+}
+
+// buildManifestFromZip unpacks every entry of assets into store, returning
+// the resulting manifest. The zip archive is only ever a transport format:
+// once its entries are in the store, the archive itself can be discarded.
+//
+// oldManifest is the manifest this one is replacing (nil or empty if
+// there's none, e.g. on first migration). A path whose hash is unchanged
+// from oldManifest already holds a reference from the previous manifest, so
+// it isn't incRef'd again here: only paths that are new, or whose content
+// changed, gain a new reference. The caller is responsible for releasing
+// oldManifest's entries that this manifest no longer carries forward (see
+// releaseStaleEntries), so that every incRef here is eventually balanced by
+// a decRef.
+func buildManifestFromZip(oldManifest assetManifest, assets *assetsFromMMAP, store *assetStore) (manifest assetManifest, err error) {
+	manifest = make(assetManifest)
+	for _, zipF := range assets.File {
+		// Normalize away the trailing "/" zip uses for directory entries, so
+		// manifest keys match the trimmed paths callers look entries up with.
+		name := strings.TrimSuffix(zipF.Name, "/")
+
+		if zipF.FileInfo().IsDir() {
+			manifest[name] = manifestEntry{IsDir: true, Mode: zipF.Mode()}
+			continue
+		}
+
+		f, err := zipF.Open()
+		if err != nil {
+			return nil, fmt.Errorf(i18n.G("can't open %q: %w"), zipF.Name, err)
+		}
+		hash, size, err := store.put(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf(i18n.G("can't store %q: %w"), zipF.Name, err)
+		}
+
+		if old, ok := oldManifest[name]; !ok || old.Hash != hash {
+			if err := store.incRef(hash); err != nil {
+				return nil, fmt.Errorf(i18n.G("can't reference %q: %w"), zipF.Name, err)
+			}
+		}
+
+		manifest[name] = manifestEntry{Hash: hash, Mode: zipF.Mode(), Size: size}
+	}
+
+	return manifest, nil
+}
+
+// migrateAssetsDB converts a legacy per-object assets.db zip cache into the
+// shared store, writing the resulting manifest to manifestPath. It is run
+// transparently by NewFromCache when a manifest is missing but a zip cache
+// is found, so existing caches get deduplicated the first time they're read.
+func migrateAssetsDB(ctx context.Context, assetsDB, manifestPath string, store *assetStore) (manifest assetManifest, err error) {
+	defer decorate.OnError(&err, i18n.G("can't migrate %s to the assets store"), assetsDB)
+
+	log.Debugf(ctx, "Migrating legacy assets cache %q to the content-addressable store", assetsDB)
+
+	assets, err := openAssetsInMemory(assetsDB)
+	if err != nil {
+		return nil, err
+	}
+	defer assets.filemmap.Close()
+
+	manifest, err = buildManifestFromZip(nil, assets, store)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := manifest.save(manifestPath); err != nil {
+		return nil, err
+	}
+
+	// The zip is now only a transport format: drop the migrated copy.
+	if err := os.Remove(assetsDB); err != nil && !os.IsNotExist(err) {
+		log.Warningf(ctx, "Couldn't remove migrated assets cache %q: %v", assetsDB, err)
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,161 @@
+package policies
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssetStorePutDedupsIdenticalContent(t *testing.T) {
+	t.Parallel()
+
+	store := newAssetStore(t.TempDir())
+
+	hash1, size1, err := store.put(strings.NewReader("hello world"))
+	require.NoError(t, err, "put should succeed")
+	hash2, size2, err := store.put(strings.NewReader("hello world"))
+	require.NoError(t, err, "put should succeed")
+
+	require.Equal(t, hash1, hash2, "identical content should hash to the same blob")
+	require.Equal(t, size1, size2, "identical content should report the same size")
+
+	entries, err := os.ReadDir(filepath.Join(store.root, hash1[:2]))
+	require.NoError(t, err, "should be able to list the shard directory")
+	require.Len(t, entries, 1, "second put of identical content should not create a second blob")
+}
+
+func TestAssetStoreIncRefDecRefRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	store := newAssetStore(t.TempDir())
+
+	hash, _, err := store.put(strings.NewReader("some asset content"))
+	require.NoError(t, err, "put should succeed")
+
+	require.NoError(t, store.incRef(hash), "first incRef should succeed")
+	require.NoError(t, store.incRef(hash), "second incRef should succeed")
+
+	// Blob is still referenced twice: dropping one reference must not reclaim it.
+	reclaimed, err := store.decRef(hash)
+	require.NoError(t, err, "decRef should succeed")
+	require.Zero(t, reclaimed, "blob still has a live reference, decRef shouldn't reclaim it")
+	require.FileExists(t, store.blobPath(hash), "blob should still be on disk")
+
+	// Dropping the last reference reclaims the blob and its metadata.
+	reclaimed, err = store.decRef(hash)
+	require.NoError(t, err, "decRef should succeed")
+	require.NotZero(t, reclaimed, "last decRef should report the reclaimed size")
+	require.NoFileExists(t, store.blobPath(hash), "blob should be removed once refcount reaches zero")
+	require.NoFileExists(t, store.refcountPath(hash), "refcount file should be removed once refcount reaches zero")
+	require.NoFileExists(t, store.modePath(hash), "mode file should be removed once refcount reaches zero")
+}
+
+func TestAssetStoreDecRefNeverGoesNegative(t *testing.T) {
+	t.Parallel()
+
+	store := newAssetStore(t.TempDir())
+
+	hash, _, err := store.put(strings.NewReader("asset with no references yet"))
+	require.NoError(t, err, "put should succeed")
+
+	// decRef on a blob that was never incRef'd shouldn't panic or underflow.
+	reclaimed, err := store.decRef(hash)
+	require.NoError(t, err, "decRef on an unreferenced blob should not error")
+	require.NotZero(t, reclaimed, "refcount should clamp at zero and reclaim immediately")
+}
+
+func TestAssetStoreLinkSameModeHardlinks(t *testing.T) {
+	t.Parallel()
+
+	store := newAssetStore(t.TempDir())
+	hash, _, err := store.put(strings.NewReader("shared content"))
+	require.NoError(t, err, "put should succeed")
+
+	destDir := t.TempDir()
+	dest1 := filepath.Join(destDir, "first")
+	dest2 := filepath.Join(destDir, "second")
+
+	require.NoError(t, store.link(hash, dest1, 0640), "first link should succeed")
+	require.NoError(t, store.link(hash, dest2, 0640), "second link at the same mode should succeed")
+
+	fi1, err := os.Stat(dest1)
+	require.NoError(t, err, "should be able to stat first destination")
+	fi2, err := os.Stat(dest2)
+	require.NoError(t, err, "should be able to stat second destination")
+
+	require.True(t, os.SameFile(fi1, fi2), "same-mode links to the same hash should share an inode")
+}
+
+func TestAssetStoreLinkDifferentModeCopiesInsteadOfHardlinking(t *testing.T) {
+	t.Parallel()
+
+	store := newAssetStore(t.TempDir())
+	hash, _, err := store.put(strings.NewReader("shared content"))
+	require.NoError(t, err, "put should succeed")
+
+	destDir := t.TempDir()
+	owner := filepath.Join(destDir, "owner")
+	other := filepath.Join(destDir, "other")
+
+	require.NoError(t, store.link(hash, owner, 0640), "first link claims 0640 for this hash")
+	require.NoError(t, store.link(hash, other, 0600), "link at a different mode must not reuse the shared inode")
+
+	fiOwner, err := os.Stat(owner)
+	require.NoError(t, err, "should be able to stat owner destination")
+	fiOther, err := os.Stat(other)
+	require.NoError(t, err, "should be able to stat other destination")
+
+	require.False(t, os.SameFile(fiOwner, fiOther), "different-mode link must be a copy, not a hardlink")
+	require.Equal(t, os.FileMode(0640), fiOwner.Mode().Perm(), "owner's mode must be untouched by the later link at a different mode")
+	require.Equal(t, os.FileMode(0600), fiOther.Mode().Perm(), "copy should carry the mode it was requested at")
+}
+
+func TestBuildManifestFromZipOnlyIncRefsNewOrChangedEntries(t *testing.T) {
+	t.Parallel()
+
+	store := newAssetStore(t.TempDir())
+
+	assetsDB := filepath.Join(t.TempDir(), "assets.db")
+	writeTestZip(t, assetsDB, map[string]string{
+		"unchanged.txt": "same content",
+		"changed.txt":   "old content",
+	})
+	assets, err := openAssetsInMemory(assetsDB)
+	require.NoError(t, err, "Setup: should be able to open the zip we just wrote")
+	defer assets.filemmap.Close()
+
+	oldManifest, err := buildManifestFromZip(nil, assets, store)
+	require.NoError(t, err, "Setup: initial buildManifestFromZip should succeed")
+
+	assetsDB2 := filepath.Join(t.TempDir(), "assets2.db")
+	writeTestZip(t, assetsDB2, map[string]string{
+		"unchanged.txt": "same content",
+		"changed.txt":   "new content",
+	})
+	assets2, err := openAssetsInMemory(assetsDB2)
+	require.NoError(t, err, "Setup: should be able to open the second zip")
+	defer assets2.filemmap.Close()
+
+	newManifest, err := buildManifestFromZip(oldManifest, assets2, store)
+	require.NoError(t, err, "buildManifestFromZip should succeed against an old manifest")
+
+	// unchanged.txt's hash is the same, so it should only carry the reference
+	// gained in the first build: decRef'ing it once should already reclaim it.
+	reclaimed, err := store.decRef(oldManifest["unchanged.txt"].Hash)
+	require.NoError(t, err, "decRef should succeed")
+	require.NotZero(t, reclaimed, "unchanged entry should not have accumulated a second reference")
+
+	// changed.txt's hash did change, so the new manifest holds a fresh
+	// reference: the old hash still has exactly the first build's reference,
+	// and the new hash has exactly the second build's.
+	reclaimed, err = store.decRef(oldManifest["changed.txt"].Hash)
+	require.NoError(t, err, "decRef should succeed")
+	require.NotZero(t, reclaimed, "old content of changed.txt should have exactly one reference left")
+
+	reclaimed, err = store.decRef(newManifest["changed.txt"].Hash)
+	require.NoError(t, err, "decRef should succeed")
+	require.NotZero(t, reclaimed, "new content of changed.txt should have exactly one reference")
+}
@@ -24,6 +24,7 @@ const (
 	PoliciesCacheBaseName  = "policies"
 	policiesFileName       = "policies"
 	policiesAssetsFileName = "assets.db"
+	policiesSumFileName    = "policies.sum"
 )
 
 type assetsFromMMAP struct {
@@ -37,6 +38,13 @@ type Policies struct {
 	assets *assetsFromMMAP `yaml:"-"`
 	// loadedFromCache indicate if the Assets are loaded from cache or point to another part of memory
 	loadedFromCache bool `yaml:"-"`
+	// cacheDir is the directory pols was loaded from, used by Verify to re-read the policies file.
+	cacheDir string `yaml:"-"`
+	// manifest and store back the assets once they have been unpacked from
+	// their transport zip into the shared content-addressable store. Either
+	// this pair or assets is set, never both.
+	manifest assetManifest `yaml:"-"`
+	store    *assetStore   `yaml:"-"`
 }
 
 // New returns new policies with GPOs and assets loaded from DB.
@@ -70,23 +78,48 @@ func NewFromCache(ctx context.Context, p string) (pols Policies, err error) {
 		return pols, err
 	}
 
+	if err := checkSum(p, d); err != nil {
+		return pols, err
+	}
+
 	if err := yaml.Unmarshal(d, &pols); err != nil {
 		return pols, err
 	}
 
 	pols.loadedFromCache = true
+	pols.cacheDir = p
 
-	// assets are optionals
-	if _, err := os.Stat(filepath.Join(p, policiesAssetsFileName)); err != nil && os.IsNotExist(err) {
+	store := newAssetStore(storeRootForCacheDir(p))
+	manifestPath := filepath.Join(p, policiesAssetsManifestFileName)
+
+	// Assets already unpacked into the shared store: this is the common case.
+	if _, err := os.Stat(manifestPath); err == nil {
+		manifest, err := openManifest(manifestPath, store)
+		if err != nil {
+			return pols, err
+		}
+		pols.manifest = manifest
+		pols.store = store
 		return pols, nil
 	}
 
-	// Now, load data from cache.
-	assets, err := openAssetsInMemory(filepath.Join(p, policiesAssetsFileName))
+	// No manifest: either there are no assets, or this is a cache written
+	// before the content-addressable store existed and still has the legacy
+	// assets.db zip, which we migrate into the store now.
+	assetsDB := filepath.Join(p, policiesAssetsFileName)
+	if _, err := os.Stat(assetsDB); err != nil {
+		if os.IsNotExist(err) {
+			return pols, nil
+		}
+		return pols, err
+	}
+
+	manifest, err := migrateAssetsDB(ctx, assetsDB, manifestPath, store)
 	if err != nil {
 		return pols, err
 	}
-	pols.assets = assets
+	pols.manifest = manifest
+	pols.store = store
 
 	return pols, nil
 }
@@ -135,46 +168,99 @@ func (pols *Policies) Save(p string) (err error) {
 	if err := os.WriteFile(filepath.Join(p, policiesFileName), d, 0600); err != nil {
 		return err
 	}
+	if err := writeSumFile(p, d); err != nil {
+		return err
+	}
 
 	assetPath := filepath.Join(p, policiesAssetsFileName)
+	manifestPath := filepath.Join(p, policiesAssetsManifestFileName)
+
+	// A manifest already saved to p (e.g. from a previous Save to the same
+	// cache directory) is about to be overwritten or dropped: release the
+	// blobs it was the only reference to before we lose track of it.
+	store := newAssetStore(storeRootForCacheDir(p))
+	var oldManifest assetManifest
+	if _, err := os.Stat(manifestPath); err == nil {
+		if oldManifest, err = openManifest(manifestPath, store); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
 	if pols.assets == nil {
-		// delete assetPath and ignore if it doesn't exist
+		// delete legacy assetPath and ignore if it doesn't exist
 		if err := os.Remove(assetPath); err != nil && !os.IsNotExist(err) {
 			return err
 		}
+		if err := releaseManifest(oldManifest, store); err != nil {
+			return err
+		}
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 		pols.loadedFromCache = true
+		pols.cacheDir = p
 		return nil
 	}
 
-	// Save assets to user cache and reload it
-	dr := &readerAtToReader{ReaderAt: pols.assets.filemmap}
-	f, err := os.Create(assetPath)
+	// Unpack assets from their transport zip into the shared
+	// content-addressable store, and reference them from a manifest.
+	// buildManifestFromZip only incRefs entries that are new or changed
+	// relative to oldManifest, so an unchanged asset doesn't accumulate a
+	// fresh reference on every refresh.
+	manifest, err := buildManifestFromZip(oldManifest, pols.assets, store)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	if _, err = io.Copy(f, dr); err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
+	if err := manifest.save(manifestPath); err != nil {
 		return err
 	}
-	// Close previous mmaped file
-	if err := pols.Close(); err != nil {
+
+	// The old manifest's entries have now either been superseded by a fresh
+	// incRef from buildManifestFromZip (path now points at different
+	// content) or dropped entirely: release whichever of its blobs the new
+	// manifest no longer references.
+	if err := releaseStaleEntries(oldManifest, manifest, store); err != nil {
 		return err
 	}
 
-	// redirect from cache
-	pols.assets, err = openAssetsInMemory(assetPath)
-	if err != nil {
+	// Close the transport zip, we only keep the manifest and store from now on.
+	if err := pols.Close(); err != nil {
 		return err
 	}
+	pols.manifest = manifest
+	pols.store = store
 	pols.loadedFromCache = true
+	pols.cacheDir = p
 
 	return nil
 }
 
+// releaseManifest decRefs every blob-backed entry of m, used when m is
+// dropped outright (the Policies it belonged to no longer has assets).
+func releaseManifest(m assetManifest, store *assetStore) error {
+	return releaseStaleEntries(m, nil, store)
+}
+
+// releaseStaleEntries decRefs every blob-backed entry of oldManifest that
+// newManifest no longer references under the same path with the same hash,
+// reclaiming blobs that dropped to a zero refcount in the process.
+func releaseStaleEntries(oldManifest, newManifest assetManifest, store *assetStore) error {
+	for path, old := range oldManifest {
+		if old.IsDir || old.Hash == "" {
+			continue
+		}
+		if cur, ok := newManifest[path]; ok && cur.Hash == old.Hash {
+			continue
+		}
+		if _, err := store.decRef(old.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Close closes underlying mmaped file.
 func (pols *Policies) Close() (err error) {
 	if pols.assets == nil {
@@ -211,6 +297,10 @@ func (pols *Policies) SaveAssetsTo(ctx context.Context, src, dest string) (err e
 
 	log.Debugf(ctx, "export assets %q to %q", src, dest)
 
+	if pols.manifest != nil {
+		return pols.saveManifestAssetsRecursively(src, dest)
+	}
+
 	if pols.assets == nil {
 		return errors.New(i18n.G("no assets attached"))
 	}
@@ -271,6 +361,54 @@ func (pols *Policies) saveAssetsRecursively(src, dest string) (err error) {
 	return nil
 }
 
+// saveManifestAssetsRecursively is the manifest/store-backed equivalent of
+// saveAssetsRecursively, linking (or copying) blobs from the shared store
+// instead of extracting them from a zip archive.
+func (pols *Policies) saveManifestAssetsRecursively(src, dest string) (err error) {
+	src = strings.TrimSuffix(src, "/")
+
+	var me manifestEntry
+	isDir := src == "."
+	if !isDir {
+		var ok bool
+		me, ok = pols.manifest[src]
+		if !ok {
+			return fmt.Errorf(i18n.G("asset %q not found in manifest"), src)
+		}
+		isDir = me.IsDir
+	}
+
+	dstPath := filepath.Join(dest, src)
+
+	if isDir {
+		if err := os.MkdirAll(dstPath, 0700); err != nil {
+			return err
+		}
+
+		prefix := strings.TrimLeft(src, "./")
+		if prefix != "" {
+			prefix += "/"
+		}
+		for name := range pols.manifest {
+			if !strings.HasPrefix(name, prefix) || name == prefix {
+				continue
+			}
+			// Only recurse into direct children: nested descendants are
+			// reached when we recurse into their parent directory entry.
+			if strings.Contains(strings.TrimPrefix(name, prefix), "/") {
+				continue
+			}
+			if err := pols.saveManifestAssetsRecursively(name, dest); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return pols.store.link(me.Hash, dstPath, me.Mode)
+}
+
 // GetUniqueRules return order rules, with one entry per key for a given type.
 // Returned file is a map of type to its entries.
 func (pols Policies) GetUniqueRules() map[string][]entry.Entry {
@@ -0,0 +1,171 @@
+package policies
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ubuntu/adsys/internal/decorate"
+	log "github.com/ubuntu/adsys/internal/grpc/logstreamer"
+	"github.com/ubuntu/adsys/internal/i18n"
+)
+
+// ErrCorruptCache is returned when a cached policies directory fails its
+// integrity check, so that callers can decide to fall back to a re-fetch
+// from AD instead of failing the current session.
+type ErrCorruptCache struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrCorruptCache) Error() string {
+	return fmt.Sprintf(i18n.G("corrupt policies cache in %s: %v"), e.Path, e.Err)
+}
+
+// Unwrap allows errors.Is/As to reach the underlying cause.
+func (e *ErrCorruptCache) Unwrap() error {
+	return e.Err
+}
+
+// checkSum verifies d (the raw content of the policies file in p) against
+// the sibling policies.sum written by Save. A missing sum file is not an
+// error: it lets us load caches written before this check existed.
+func checkSum(p string, d []byte) error {
+	want, err := os.ReadFile(filepath.Join(p, policiesSumFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	got := sha256Hex(d)
+	if string(want) != got {
+		return &ErrCorruptCache{Path: p, Err: fmt.Errorf(i18n.G("policies file checksum mismatch"))}
+	}
+
+	return nil
+}
+
+// writeSumFile atomically (re)writes the policies.sum file next to the
+// serialized policies data d in p.
+func writeSumFile(p string, d []byte) (err error) {
+	defer decorate.OnError(&err, i18n.G("can't write policies checksum to %s"), p)
+
+	tmp, err := os.CreateTemp(p, policiesSumFileName+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(sha256Hex(d)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(p, policiesSumFileName))
+}
+
+func sha256Hex(d []byte) string {
+	sum := sha256.Sum256(d)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify recomputes the checksum of the cached policies file and walks the
+// assets archive, making sure every entry's content matches its declared
+// CRC32 and that regular files (mount and script assets in particular) open
+// correctly and match their declared size. Assets already unpacked into the
+// shared store (as for every policies loaded from cache) have no archive:
+// each blob's SHA-256 and size are checked against the manifest instead.
+// It is meant to be run as a repair
+// pass over /var/cache/adsys, e.g. from the "adsysctl policy verify" command.
+func (pols *Policies) Verify(ctx context.Context) (err error) {
+	defer decorate.OnError(&err, i18n.G("policies cache verification failed"))
+
+	log.Debugf(ctx, "Verifying policies cache integrity")
+
+	if pols.cacheDir != "" {
+		d, err := os.ReadFile(filepath.Join(pols.cacheDir, policiesFileName))
+		if err != nil {
+			return err
+		}
+		if err := checkSum(pols.cacheDir, d); err != nil {
+			return err
+		}
+	}
+
+	if pols.manifest != nil {
+		return pols.verifyManifest()
+	}
+
+	if pols.assets == nil {
+		return nil
+	}
+
+	for _, zipF := range pols.assets.File {
+		if zipF.FileInfo().IsDir() {
+			continue
+		}
+
+		f, err := zipF.Open()
+		if err != nil {
+			return fmt.Errorf(i18n.G("can't open asset %q: %w"), zipF.Name, err)
+		}
+
+		// Streaming the decompressed bytes forces archive/zip to validate
+		// the entry's CRC32 against the central directory value, returning
+		// zip.ErrChecksum on mismatch.
+		n, err := io.Copy(io.Discard, f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf(i18n.G("corrupted asset %q: %w"), zipF.Name, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf(i18n.G("can't close asset %q: %w"), zipF.Name, err)
+		}
+
+		if uint64(n) != zipF.UncompressedSize64 {
+			return fmt.Errorf(i18n.G("asset %q has size %d, expected %d"), zipF.Name, n, zipF.UncompressedSize64)
+		}
+	}
+
+	return nil
+}
+
+// verifyManifest checks every manifest entry's blob still matches its
+// declared hash and size in the shared store.
+func (pols *Policies) verifyManifest() error {
+	for name, me := range pols.manifest {
+		if me.IsDir {
+			continue
+		}
+
+		f, err := os.Open(pols.store.blobPath(me.Hash))
+		if err != nil {
+			return fmt.Errorf(i18n.G("can't open asset %q blob: %w"), name, err)
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf(i18n.G("can't read asset %q blob: %w"), name, err)
+		}
+
+		if got := hex.EncodeToString(h.Sum(nil)); got != me.Hash {
+			return fmt.Errorf(i18n.G("asset %q blob is corrupt: hash is %s, expected %s"), name, got, me.Hash)
+		}
+		if n != me.Size {
+			return fmt.Errorf(i18n.G("asset %q blob has size %d, expected %d"), name, n, me.Size)
+		}
+	}
+
+	return nil
+}
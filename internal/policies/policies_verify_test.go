@@ -0,0 +1,76 @@
+package policies
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyManifestBackedCacheHappyPath(t *testing.T) {
+	t.Parallel()
+
+	pols, cacheDir := newTestManifestBackedPolicies(t, map[string]string{
+		"file.txt": "some content",
+	})
+
+	require.NoError(t, pols.Verify(context.Background()), "Verify should succeed against an untouched cache")
+
+	// A fresh NewFromCache load should also verify cleanly.
+	reloaded, err := NewFromCache(context.Background(), cacheDir)
+	require.NoError(t, err, "NewFromCache should succeed against an untouched cache")
+	require.NoError(t, reloaded.Verify(context.Background()), "Verify should succeed after reloading from cache")
+}
+
+func TestVerifyDetectsCorruptBlob(t *testing.T) {
+	t.Parallel()
+
+	pols, _ := newTestManifestBackedPolicies(t, map[string]string{
+		"file.txt": "some content",
+	})
+
+	me := pols.manifest["file.txt"]
+	require.NoError(t, os.WriteFile(pols.store.blobPath(me.Hash), []byte("tampered content"), 0600), "Setup: should be able to corrupt the blob")
+
+	err := pols.Verify(context.Background())
+	require.Error(t, err, "Verify should detect a blob whose content no longer matches its declared hash")
+}
+
+func TestNewFromCacheDetectsCorruptPoliciesFile(t *testing.T) {
+	t.Parallel()
+
+	_, cacheDir := newTestManifestBackedPolicies(t, map[string]string{
+		"file.txt": "some content",
+	})
+
+	policiesPath := filepath.Join(cacheDir, policiesFileName)
+	d, err := os.ReadFile(policiesPath)
+	require.NoError(t, err, "Setup: should be able to read the policies file")
+	require.NoError(t, os.WriteFile(policiesPath, append(d, []byte("tampered")...), 0600), "Setup: should be able to tamper with the policies file")
+
+	_, err = NewFromCache(context.Background(), cacheDir)
+	require.Error(t, err, "NewFromCache should reject a policies file that doesn't match its checksum")
+
+	var corruptErr *ErrCorruptCache
+	require.ErrorAs(t, err, &corruptErr, "NewFromCache should return a typed ErrCorruptCache")
+}
+
+// newTestManifestBackedPolicies builds a Policies backed by the
+// content-addressable store (as produced by Save) from an in-memory zip of
+// files, and returns it along with the cache directory it was saved to.
+func newTestManifestBackedPolicies(t *testing.T, files map[string]string) (Policies, string) {
+	t.Helper()
+
+	assetsDB := filepath.Join(t.TempDir(), "assets.db")
+	writeTestZip(t, assetsDB, files)
+
+	pols, err := New(context.Background(), nil, assetsDB)
+	require.NoError(t, err, "Setup: New should succeed")
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, pols.Save(cacheDir), "Setup: Save should succeed")
+
+	return pols, cacheDir
+}
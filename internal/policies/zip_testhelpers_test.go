@@ -0,0 +1,28 @@
+package policies
+
+import (
+	"archive/zip"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestZip writes a zip archive at path with one entry per name -> content
+// pair in files, in the same layout Policies expects its assets.db to have.
+func writeTestZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	require.NoError(t, err, "Setup: should be able to create %s", path)
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		entry, err := w.Create(name)
+		require.NoError(t, err, "Setup: should be able to add %s to the zip", name)
+		_, err = entry.Write([]byte(content))
+		require.NoError(t, err, "Setup: should be able to write %s's content", name)
+	}
+	require.NoError(t, w.Close(), "Setup: should be able to close the zip writer")
+}